@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dippynark/kfmt/discovery"
+	"github.com/dippynark/kfmt/secrets"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const baseDirectory = "base"
+
+// clusterInputDirs groups the --input-dir values sharing a single cluster label, in the
+// order that label first appeared on the command line. An empty cluster means no labels
+// were used at all, in which case it is the only entry.
+type clusterInputDirs struct {
+	cluster string
+	dirs    []string
+}
+
+// parseInputDirs groups raw --input-dir values (plain "dir" or labelled "cluster=dir")
+// by cluster label, preserving first-seen order. Entries must either all be labelled or
+// all be plain; mixing the two is rejected.
+func parseInputDirs(raw []string) ([]clusterInputDirs, error) {
+	var groups []clusterInputDirs
+	index := map[string]int{}
+	var labeled, bare bool
+
+	for _, entry := range raw {
+		cluster, dir := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			cluster, dir = entry[:i], entry[i+1:]
+			labeled = true
+		} else {
+			bare = true
+		}
+
+		if labeled && bare {
+			return nil, fmt.Errorf("--%s entries must either all be cluster=dir or all be plain dir, not a mix", inputDirFlag)
+		}
+
+		if idx, ok := index[cluster]; ok {
+			groups[idx].dirs = append(groups[idx].dirs, dir)
+			continue
+		}
+		index[cluster] = len(groups)
+		groups = append(groups, clusterInputDirs{cluster: cluster, dirs: []string{dir}})
+	}
+
+	return groups, nil
+}
+
+// runMultiCluster runs runTree once per cluster, writing each into outputDir/<cluster>/,
+// then extracts resources that ended up byte-identical across every cluster into a
+// top-level outputDir/base/ tree so overlays only need to carry what differs.
+func (o *Options) runMultiCluster(clusters []clusterInputDirs, resourceScopes discovery.ResourceScopes, secretTransformer secrets.SecretTransformer) error {
+	for _, cluster := range clusters {
+		clusterOpts := *o
+		clusterOpts.outputDir = filepath.Join(o.outputDir, cluster.cluster)
+
+		// Each cluster gets its own copy of the scope fallback: a CRD bundled with one
+		// cluster's input shouldn't silently resolve GVKs for another cluster.
+		clusterScopes := make(discovery.ResourceScopes, len(resourceScopes))
+		for gvk, scope := range resourceScopes {
+			clusterScopes[gvk] = scope
+		}
+
+		if _, err := clusterOpts.runTree(cluster.dirs, clusterScopes, secretTransformer); err != nil {
+			return errors.Wrapf(err, "failed to process cluster %q", cluster.cluster)
+		}
+	}
+
+	return o.extractBase(clusters)
+}
+
+// clusterFile is one cluster's copy of a file found at the same path, relative to that
+// cluster's own output directory, across every cluster's output tree.
+type clusterFile struct {
+	cluster string
+	path    string
+	content []byte
+}
+
+// extractBase walks every cluster's output tree and, for any relative path present under
+// every cluster, either moves it into outputDir/base/ (when byte-identical everywhere) or,
+// with --diff-base, moves the first cluster's copy to base/ and rewrites every other
+// cluster's copy as a strategic-merge-patch delta against it.
+func (o *Options) extractBase(clusters []clusterInputDirs) error {
+	byRelPath := map[string][]clusterFile{}
+
+	for _, cluster := range clusters {
+		clusterDir := filepath.Join(o.outputDir, cluster.cluster)
+		err := filepath.Walk(clusterDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || filepath.Base(path) == kustomizationFileName {
+				return nil
+			}
+
+			rel, err := filepath.Rel(clusterDir, path)
+			if err != nil {
+				return err
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			byRelPath[rel] = append(byRelPath[rel], clusterFile{cluster: cluster.cluster, path: path, content: content})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for rel, files := range byRelPath {
+		// Only present in some clusters: nothing common to extract
+		if len(files) != len(clusters) {
+			continue
+		}
+
+		if err := o.extractBaseFile(rel, files); err != nil {
+			return errors.Wrapf(err, "failed to extract base copy of %s", rel)
+		}
+	}
+
+	if o.emitKustomization {
+		if err := o.writeKustomizations(); err != nil {
+			return err
+		}
+	}
+
+	return removeEmptyDirs(o.outputDir)
+}
+
+func (o *Options) extractBaseFile(rel string, files []clusterFile) error {
+	identical := true
+	for _, file := range files[1:] {
+		if !bytes.Equal(file.content, files[0].content) {
+			identical = false
+			break
+		}
+	}
+
+	if !identical && !o.diffBase {
+		// Genuinely differs across clusters and there's nowhere to record a delta: leave
+		// every cluster's copy as a full, independent resource.
+		return nil
+	}
+
+	basePath := filepath.Join(o.outputDir, baseDirectory, rel)
+	if err := os.MkdirAll(filepath.Dir(basePath), defaultDirectoryPerms); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(basePath, files[0].content, defaultFilePerms); err != nil {
+		return err
+	}
+
+	if err := os.Remove(files[0].path); err != nil {
+		return err
+	}
+
+	for _, file := range files[1:] {
+		if bytes.Equal(file.content, files[0].content) {
+			if err := os.Remove(file.path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		patch, err := strategicMergePatch(files[0].content, file.content)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file.path, patch, defaultFilePerms); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// strategicMergePatch renders a patch carrying only the fields of overlay that differ from
+// base (see diffMapping: mappings are diffed key by key and fields missing from overlay are
+// written as null), plus apiVersion/kind/metadata.name/metadata.namespace so the patch can
+// be identified and merged by `kustomize build` as a strategic-merge-patch target.
+func strategicMergePatch(baseBytes, overlayBytes []byte) ([]byte, error) {
+	baseNode, err := yaml.Parse(string(baseBytes))
+	if err != nil {
+		return nil, err
+	}
+	overlayNode, err := yaml.Parse(string(overlayBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	apiVersion, err := getAPIVersion(overlayNode)
+	if err != nil {
+		return nil, err
+	}
+	kind, err := getKind(overlayNode)
+	if err != nil {
+		return nil, err
+	}
+	name, err := getName(overlayNode)
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := getNamespace(overlayNode)
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	b.WriteString(configSeparator)
+	fmt.Fprintf(&b, "apiVersion: %s\n", apiVersion)
+	fmt.Fprintf(&b, "kind: %s\n", kind)
+	b.WriteString("metadata:\n")
+	fmt.Fprintf(&b, "  name: %s\n", name)
+	if namespace != "" {
+		fmt.Fprintf(&b, "  namespace: %s\n", namespace)
+	}
+
+	// name/namespace identify the patch target and are always written above regardless
+	// of whether they differ from base; every other metadata sub-field (labels,
+	// annotations, ...) is diffed the same way as the remaining top-level fields below,
+	// so a cluster-specific label or annotation isn't silently dropped from the patch.
+	overlayMetadata, err := overlayNode.Pipe(yaml.Lookup("metadata"))
+	if err != nil {
+		return nil, err
+	}
+	baseMetadata, err := baseNode.Pipe(yaml.Lookup("metadata"))
+	if err != nil {
+		return nil, err
+	}
+	if err := diffMapping(&b, baseMetadata, overlayMetadata, 2, "name", "namespace"); err != nil {
+		return nil, err
+	}
+
+	if err := diffMapping(&b, baseNode, overlayNode, 0, "apiVersion", "kind", "metadata"); err != nil {
+		return nil, err
+	}
+
+	return []byte(b.String()), nil
+}
+
+// diffMapping writes, at indent spaces of indentation, every field of overlayParent that
+// differs from baseParent's copy, skipping the names in skip (fields already written
+// unconditionally by the caller). A field present in baseParent but absent from
+// overlayParent is written as an explicit `null`, the standard strategic-merge/JSON-merge
+// deletion marker: an omitted key merges as "leave base alone," so a dropped field must be
+// nulled out rather than simply left out of the patch. A field whose value is a mapping on
+// both sides is recursed into so a key dropped *within* e.g. data/labels is nulled out too,
+// rather than only the field as a whole being diffed.
+func diffMapping(b *strings.Builder, baseParent, overlayParent *yaml.RNode, indent int, skip ...string) error {
+	if overlayParent == nil {
+		return nil
+	}
+
+	overlayFields, err := overlayParent.Fields()
+	if err != nil {
+		return err
+	}
+	overlayFieldSet := map[string]bool{}
+	for _, field := range overlayFields {
+		overlayFieldSet[field] = true
+	}
+
+	var baseFields []string
+	if baseParent != nil {
+		if baseFields, err = baseParent.Fields(); err != nil {
+			return err
+		}
+	}
+
+	pad := strings.Repeat(" ", indent)
+	for _, field := range overlayFields {
+		if contains(skip, field) {
+			continue
+		}
+
+		overlayValue, err := overlayParent.Pipe(yaml.Lookup(field))
+		if err != nil {
+			return err
+		}
+
+		var baseValue *yaml.RNode
+		if baseParent != nil {
+			if baseValue, err = baseParent.Pipe(yaml.Lookup(field)); err != nil {
+				return err
+			}
+		}
+
+		if overlayValue.YNode().Kind == yaml.MappingNode && (baseValue == nil || baseValue.YNode().Kind == yaml.MappingNode) {
+			var nested strings.Builder
+			if err := diffMapping(&nested, baseValue, overlayValue, indent+2); err != nil {
+				return err
+			}
+			if nested.Len() > 0 {
+				fmt.Fprintf(b, "%s%s:\n", pad, field)
+				b.WriteString(nested.String())
+			}
+			continue
+		}
+
+		overlayValueYAML, err := overlayValue.String()
+		if err != nil {
+			return err
+		}
+
+		baseValueYAML := ""
+		if baseValue != nil {
+			if baseValueYAML, err = baseValue.String(); err != nil {
+				return err
+			}
+		}
+
+		if overlayValueYAML == baseValueYAML {
+			continue
+		}
+
+		fmt.Fprintf(b, "%s%s:\n", pad, field)
+		for _, line := range strings.Split(strings.TrimRight(overlayValueYAML, "\n"), "\n") {
+			fmt.Fprintf(b, "%s  %s\n", pad, line)
+		}
+	}
+
+	for _, field := range baseFields {
+		if contains(skip, field) || overlayFieldSet[field] {
+			continue
+		}
+		fmt.Fprintf(b, "%s%s: null\n", pad, field)
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEmptyDirs removes any directory under root left empty after base extraction
+func removeEmptyDirs(root string) error {
+	var dirs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deepest first, so a directory only left with now-empty subdirectories is removed too
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], string(os.PathSeparator)) > strings.Count(dirs[j], string(os.PathSeparator))
+	})
+
+	for _, dir := range dirs {
+		if dir == root {
+			continue
+		}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// apiServerResourceInspector answers scope questions from resources added
+// locally or cached from earlier lookups, then from a live API server
+// (caching its answers) and, as a last resort, a caller-seeded
+// ResourceScopes table.
+// It is safe for concurrent use, since IsNamespaced is called from the
+// config-planning worker pool.
+type apiServerResourceInspector struct {
+	discoveryClient discovery.DiscoveryInterface
+
+	mu             sync.Mutex
+	resources      map[schema.GroupVersionKind]bool
+	resourceScopes ResourceScopes
+}
+
+// NewAPIServerResourceInspector constructs a ResourceInspector backed by the
+// API server referenced by restConfig. scopes is consulted as a last resort
+// when neither the API server nor a locally added resource knows about a
+// GVK; it may be nil.
+func NewAPIServerResourceInspector(restConfig *rest.Config, scopes ResourceScopes) (ResourceInspector, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiServerResourceInspector{
+		discoveryClient: discoveryClient,
+		resources:       map[schema.GroupVersionKind]bool{},
+		resourceScopes:  scopes,
+	}, nil
+}
+
+func (i *apiServerResourceInspector) IsNamespaced(gvk schema.GroupVersionKind) (bool, error) {
+	i.mu.Lock()
+	namespaced, ok := i.resources[gvk]
+	i.mu.Unlock()
+	if ok {
+		return namespaced, nil
+	}
+
+	if namespaced, ok := i.lookupServer(gvk); ok {
+		return namespaced, nil
+	}
+
+	if namespaced, ok := i.resourceScopes.lookup(gvk); ok {
+		return namespaced, nil
+	}
+
+	return false, fmt.Errorf("unable to determine whether resource is namespaced: %s", gvk.String())
+}
+
+// lookupServer queries the API server for gvk's namespaced/cluster-scoped status and
+// caches a successful answer into i.resources, so repeated lookups of the same GVK (e.g.
+// hundreds of Deployments across an input tree) cost one discovery call, not one per
+// resource.
+func (i *apiServerResourceInspector) lookupServer(gvk schema.GroupVersionKind) (bool, bool) {
+	resourceList, err := i.discoveryClient.ServerResourcesForGroupVersion(gvk.GroupVersion().String())
+	if err != nil {
+		return false, false
+	}
+
+	for _, resource := range resourceList.APIResources {
+		if resource.Kind == gvk.Kind {
+			i.mu.Lock()
+			i.resources[gvk] = resource.Namespaced
+			i.mu.Unlock()
+			return resource.Namespaced, true
+		}
+	}
+
+	return false, false
+}
+
+func (i *apiServerResourceInspector) IsCoreGroup(group string) bool {
+	return group == ""
+}
+
+func (i *apiServerResourceInspector) AddResource(gvk schema.GroupVersionKind, namespaced bool) {
+	i.mu.Lock()
+	i.resources[gvk] = namespaced
+	i.mu.Unlock()
+}
@@ -0,0 +1,45 @@
+package discovery
+
+import (
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ResourceInspector answers scope questions about Kubernetes resource kinds,
+// combining a backing discovery mechanism (the local built-in table or a
+// live API server) with any resources added at runtime via AddResource.
+type ResourceInspector interface {
+	// IsNamespaced reports whether gvk is a namespace-scoped resource.
+	IsNamespaced(gvk schema.GroupVersionKind) (bool, error)
+	// IsCoreGroup reports whether group is the core/legacy Kubernetes API group.
+	IsCoreGroup(group string) bool
+	// AddResource records the scope of a resource discovered locally (e.g.
+	// from a CustomResourceDefinition manifest) so it can be looked up even
+	// if the backing discovery mechanism does not know about it.
+	AddResource(gvk schema.GroupVersionKind, namespaced bool)
+}
+
+// ResourceScopes is a per-run table of resource scopes that callers can seed
+// as a last-resort fallback, for GVKs that neither the backing discovery
+// mechanism nor any CustomResourceDefinition in the input set can resolve
+// (e.g. a CR whose CRD lives outside the input, or a Helm chart that bundles
+// CRs without their CRDs). Entries with an empty Version match any version of
+// the Group/Kind, mirroring how --assume-namespaced/--assume-cluster-scoped
+// are specified on the CLI.
+type ResourceScopes map[schema.GroupVersionKind]apiextensionsv1beta1.ResourceScope
+
+// lookup resolves gvk against scopes, first trying an exact match and then
+// falling back to a version-agnostic Group/Kind match.
+func (scopes ResourceScopes) lookup(gvk schema.GroupVersionKind) (bool, bool) {
+	if scope, ok := scopes[gvk]; ok {
+		return scope == apiextensionsv1beta1.NamespaceScoped, true
+	}
+
+	versionless := gvk
+	versionless.Version = ""
+	if scope, ok := scopes[versionless]; ok {
+		return scope == apiextensionsv1beta1.NamespaceScoped, true
+	}
+
+	return false, false
+}
@@ -0,0 +1,51 @@
+package discovery
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// localResourceInspector answers scope questions using the built-in
+// gvkNamespaced table (generated by discovery-gen.go from k8s.io/api),
+// extended at runtime with any resources discovered locally and, as a last
+// resort, a caller-seeded ResourceScopes table.
+type localResourceInspector struct {
+	resources      map[schema.GroupVersionKind]bool
+	resourceScopes ResourceScopes
+}
+
+// NewLocalResourceInspector constructs a ResourceInspector backed by the
+// built-in gvkNamespaced table rather than a live API server. scopes is
+// consulted as a last resort when neither the table nor a locally added
+// resource knows about a GVK; it may be nil.
+func NewLocalResourceInspector(scopes ResourceScopes) ResourceInspector {
+	return &localResourceInspector{
+		resources:      map[schema.GroupVersionKind]bool{},
+		resourceScopes: scopes,
+	}
+}
+
+func (i *localResourceInspector) IsNamespaced(gvk schema.GroupVersionKind) (bool, error) {
+	if namespaced, ok := i.resources[gvk]; ok {
+		return namespaced, nil
+	}
+
+	if namespaced, ok := gvkNamespaced[gvk]; ok {
+		return namespaced, nil
+	}
+
+	if namespaced, ok := i.resourceScopes.lookup(gvk); ok {
+		return namespaced, nil
+	}
+
+	return false, fmt.Errorf("unable to determine whether resource is namespaced: %s", gvk.String())
+}
+
+func (i *localResourceInspector) IsCoreGroup(group string) bool {
+	return group == ""
+}
+
+func (i *localResourceInspector) AddResource(gvk schema.GroupVersionKind, namespaced bool) {
+	i.resources[gvk] = namespaced
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+)
+
+const kustomizationFileName = "kustomization.yaml"
+
+// writeKustomizations walks outputDir and generates a kustomization.yaml in every
+// directory so the canonicalised tree can be consumed directly by `kustomize build`:
+// leaf directories list their sibling YAMLs under resources, and parent directories
+// (cluster/, namespaces/, namespaces/<ns>/) list their child directories.
+func (o *Options) writeKustomizations() error {
+	dirs, err := listDirs(o.outputDir)
+	if err != nil {
+		return err
+	}
+
+	// Process the deepest directories first so that parent kustomizations only
+	// reference children that ended up with a kustomization.yaml of their own.
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], string(os.PathSeparator)) > strings.Count(dirs[j], string(os.PathSeparator))
+	})
+
+	for _, dir := range dirs {
+		if err := o.writeKustomization(dir); err != nil {
+			return errors.Wrapf(err, "failed to write %s in %s", kustomizationFileName, dir)
+		}
+	}
+
+	return nil
+}
+
+// listDirs lists outputDir and every directory beneath it
+func listDirs(outputDir string) ([]string, error) {
+	var dirs []string
+
+	err := filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+
+	return dirs, err
+}
+
+// writeKustomization generates the kustomization.yaml for a single directory, listing
+// its sibling YAMLs and any child directories that were given a kustomization.yaml
+func (o *Options) writeKustomization(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var resources []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if _, err := os.Stat(filepath.Join(dir, entry.Name(), kustomizationFileName)); err == nil {
+				resources = append(resources, entry.Name())
+			}
+			continue
+		}
+		if entry.Name() == kustomizationFileName {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), ".yaml") || strings.HasSuffix(entry.Name(), ".yml") {
+			resources = append(resources, entry.Name())
+		}
+	}
+
+	// Don't emit a kustomization.yaml for a directory with nothing to reference. Remove
+	// any stale one left over from an earlier pass (e.g. every resource that used to
+	// live here having since been extracted into base/), so removeEmptyDirs can clean
+	// up the now-empty directory instead of leaving a dangling kustomization.yaml behind.
+	if len(resources) == 0 {
+		existing := filepath.Join(dir, kustomizationFileName)
+		if _, err := os.Stat(existing); err == nil {
+			if err := os.Remove(existing); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sort.Strings(resources)
+
+	namespace := ""
+	if o.kustomizeNamespace && isNamespaceDirectory(dir) {
+		namespace = filepath.Base(dir)
+		if err := stripNamespaceField(dir, entries); err != nil {
+			return err
+		}
+	}
+
+	return writeKustomizationFile(dir, namespace, resources)
+}
+
+// isNamespaceDirectory reports whether dir is a namespaces/<ns> leaf directory. It matches
+// on the trailing two path components rather than depth from a particular root, so it
+// still identifies e.g. <cluster>/namespaces/<ns> when outputDir is regenerated from a
+// different root (such as the top-level outputDir during multi-cluster base extraction).
+func isNamespaceDirectory(dir string) bool {
+	return filepath.Base(filepath.Dir(dir)) == namespacedDirectory
+}
+
+// stripNamespaceField removes metadata.namespace from every resource in dir, mirroring
+// the --clean behaviour, since the generated kustomization.yaml now sets namespace:
+// for the whole directory
+func stripNamespaceField(dir string, entries []os.FileInfo) error {
+	for _, entry := range entries {
+		if entry.IsDir() || !(strings.HasSuffix(entry.Name(), ".yaml") || strings.HasSuffix(entry.Name(), ".yml")) {
+			continue
+		}
+
+		file := filepath.Join(dir, entry.Name())
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		nodes, err := kio.FromBytes(b)
+		if err != nil {
+			return err
+		}
+
+		var out strings.Builder
+		for _, node := range nodes {
+			if err := node.SetNamespace(""); err != nil {
+				return err
+			}
+			s, err := node.String()
+			if err != nil {
+				return err
+			}
+			out.WriteString(configSeparator)
+			out.WriteString(s)
+		}
+
+		if err := ioutil.WriteFile(file, []byte(out.String()), defaultFilePerms); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeKustomizationFile renders and writes the kustomization.yaml for dir
+func writeKustomizationFile(dir, namespace string, resources []string) error {
+	var b strings.Builder
+	b.WriteString("apiVersion: kustomize.config.k8s.io/v1beta1\n")
+	b.WriteString("kind: Kustomization\n")
+	if namespace != "" {
+		fmt.Fprintf(&b, "namespace: %s\n", namespace)
+	}
+	b.WriteString("resources:\n")
+	for _, resource := range resources {
+		fmt.Fprintf(&b, "- %s\n", resource)
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, kustomizationFileName), []byte(b.String()), defaultFilePerms)
+}
@@ -6,13 +6,16 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 
 	"github.com/dippynark/kfmt/discovery"
+	"github.com/dippynark/kfmt/secrets"
 	"github.com/jenkins-x/jx-helpers/v3/pkg/cobras/helper"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
@@ -29,6 +32,25 @@ const (
 	filterKindGroupFlag = "filter-kind-group"
 	cleanFlag           = "clean"
 
+	assumeNamespacedFlag    = "assume-namespaced"
+	assumeClusterScopedFlag = "assume-cluster-scoped"
+
+	emitKustomizationFlag  = "emit-kustomization"
+	kustomizeNamespaceFlag = "kustomize-namespace"
+
+	secretModeFlag      = "secret-mode"
+	secretRecipientFlag = "secret-recipient"
+	secretCertFileFlag  = "secret-cert-file"
+	secretKeyFileFlag   = "secret-key-file"
+	secretCAFileFlag    = "secret-ca-file"
+	secretInClusterFlag = "secret-in-cluster"
+
+	diffBaseFlag = "diff-base"
+
+	replacementsFlag = "replacements"
+
+	concurrencyFlag = "concurrency"
+
 	kubeconfigEnvVar = "KUBECONFIG"
 
 	configSeparator = "---\n"
@@ -43,13 +65,26 @@ const (
 var quotes = []string{"'", "\""}
 
 type Options struct {
-	inputDirs          []string
-	outputDir          string
-	discovery          bool
-	kubeconfig         string
-	removeInput        bool
-	filteredKindGroups []string
-	clean              bool
+	inputDirs           []string
+	outputDir           string
+	discovery           bool
+	kubeconfig          string
+	removeInput         bool
+	filteredKindGroups  []string
+	clean               bool
+	assumeNamespaced    []string
+	assumeClusterScoped []string
+	emitKustomization   bool
+	kustomizeNamespace  bool
+	secretMode          string
+	secretRecipient     string
+	secretCertFile      string
+	secretKeyFile       string
+	secretCAFile        string
+	secretInCluster     bool
+	diffBase            bool
+	replacementsFile    string
+	concurrency         int
 }
 
 func main() {
@@ -65,12 +100,25 @@ func main() {
 	}
 
 	cmd.Flags().BoolP("help", "h", false, "Help for kfmt")
-	cmd.Flags().StringArrayVarP(&o.inputDirs, inputDirFlag, string([]rune(inputDirFlag)[0]), []string{}, "Directories containing hydrated configs")
+	cmd.Flags().StringArrayVarP(&o.inputDirs, inputDirFlag, string([]rune(inputDirFlag)[0]), []string{}, "Directories containing hydrated configs. May be repeated with a cluster=dir label (e.g. prod=./hydrated/prod) to produce a per-cluster output tree")
 	cmd.Flags().StringVarP(&o.outputDir, outputDirFlag, string([]rune(outputDirFlag)[0]), "", "Output directory")
 	cmd.Flags().BoolVarP(&o.discovery, discoveryFlag, string([]rune(discoveryFlag)[0]), false, "Use API Server for discovery")
 	cmd.Flags().BoolVarP(&o.removeInput, removeInputFlag, string([]rune(removeInputFlag)[0]), false, "Remove processed input files")
 	cmd.Flags().StringArrayVarP(&o.filteredKindGroups, filterKindGroupFlag, string([]rune(filterKindGroupFlag)[0]), []string{}, "Filter kind.group from output configs (e.g. Deployment.apps or Secret)")
 	cmd.Flags().BoolVarP(&o.clean, cleanFlag, string([]rune(cleanFlag)[0]), false, "Remove namespace field from non-namespaced resources")
+	cmd.Flags().StringArrayVar(&o.assumeNamespaced, assumeNamespacedFlag, []string{}, "Assume Group/Kind is namespace-scoped when discovery does not know about it (e.g. cert-manager.io/Certificate)")
+	cmd.Flags().StringArrayVar(&o.assumeClusterScoped, assumeClusterScopedFlag, []string{}, "Assume Group/Kind is cluster-scoped when discovery does not know about it (e.g. acme.cert-manager.io/Order)")
+	cmd.Flags().BoolVar(&o.emitKustomization, emitKustomizationFlag, false, "Generate a kustomization.yaml in every directory of the output tree")
+	cmd.Flags().BoolVar(&o.kustomizeNamespace, kustomizeNamespaceFlag, false, "Set namespace in each namespace kustomization.yaml and remove metadata.namespace from its resources (requires --"+emitKustomizationFlag+")")
+	cmd.Flags().StringVar(&o.secretMode, secretModeFlag, secrets.ModePassthrough, "How to handle Secret configs: passthrough, redact, sops or sealed-secrets")
+	cmd.Flags().StringVar(&o.secretRecipient, secretRecipientFlag, "", "Recipient for --secret-mode=sops (age or PGP key) or controller URL for --secret-mode=sealed-secrets")
+	cmd.Flags().StringVar(&o.secretCertFile, secretCertFileFlag, "", "Client certificate used to authenticate to the kubeseal controller for --secret-mode=sealed-secrets (requires --"+secretKeyFileFlag+")")
+	cmd.Flags().StringVar(&o.secretKeyFile, secretKeyFileFlag, "", "Client private key used to authenticate to the kubeseal controller for --secret-mode=sealed-secrets (requires --"+secretCertFileFlag+")")
+	cmd.Flags().StringVar(&o.secretCAFile, secretCAFileFlag, "", "CA bundle used to verify the kubeseal controller's certificate for --secret-mode=sealed-secrets")
+	cmd.Flags().BoolVar(&o.secretInCluster, secretInClusterFlag, false, "Authenticate to the kubeseal controller using the pod's own service account token and cluster CA for --secret-mode=sealed-secrets")
+	cmd.Flags().BoolVar(&o.diffBase, diffBaseFlag, false, "With multiple --"+inputDirFlag+" clusters, write per-cluster files that differ from the base copy as a strategic-merge-patch delta instead of leaving them untouched")
+	cmd.Flags().StringVar(&o.replacementsFile, replacementsFlag, "", "File containing a list of kustomize-style Replacement entries to apply across input configs before writing output")
+	cmd.Flags().IntVar(&o.concurrency, concurrencyFlag, runtime.NumCPU(), "Number of workers used to plan output configs (input files are parsed beforehand, serially)")
 
 	// https://github.com/kubernetes/client-go/blob/b72204b2445de5ac815ae2bb993f6182d271fdb4/examples/out-of-cluster-client-configuration/main.go#L45-L49
 	if kubeconfigEnvVarValue := os.Getenv(kubeconfigEnvVar); kubeconfigEnvVarValue != "" {
@@ -95,12 +143,59 @@ func (o *Options) Run() error {
 	if o.outputDir == "" {
 		return errors.Errorf("--%s is not set", outputDirFlag)
 	}
+	if o.kustomizeNamespace && !o.emitKustomization {
+		return errors.Errorf("--%s requires --%s", kustomizeNamespaceFlag, emitKustomizationFlag)
+	}
+
+	clusters, err := parseInputDirs(o.inputDirs)
+	if err != nil {
+		return err
+	}
+	if o.diffBase && len(clusters) < 2 {
+		return errors.Errorf("--%s requires at least two distinct %s clusters", diffBaseFlag, inputDirFlag)
+	}
+
+	// Seed the resource scope fallback from --assume-namespaced/--assume-cluster-scoped
+	// so that kinds discovery can't resolve (e.g. a CR whose CRD lives outside the
+	// input set) can still be placed.
+	resourceScopes, err := parseResourceScopes(o.assumeNamespaced, o.assumeClusterScoped)
+	if err != nil {
+		return err
+	}
+
+	secretTransformer, err := secrets.New(o.secretMode, secrets.Options{
+		Recipient: o.secretRecipient,
+		// age recipients always start with "age1"; anything else is assumed to be a PGP
+		// fingerprint, matching how sops itself distinguishes the two on the command line.
+		PGP:       o.secretRecipient != "" && !strings.HasPrefix(o.secretRecipient, "age1"),
+		CertFile:  o.secretCertFile,
+		KeyFile:   o.secretKeyFile,
+		CAFile:    o.secretCAFile,
+		InCluster: o.secretInCluster,
+	})
+	if err != nil {
+		return err
+	}
+
+	// No cluster labels were used: keep the single flat tree behaviour unchanged
+	if len(clusters) == 1 && clusters[0].cluster == "" {
+		_, err := o.runTree(clusters[0].dirs, resourceScopes, secretTransformer)
+		return err
+	}
+
+	return o.runMultiCluster(clusters, resourceScopes, secretTransformer)
+}
+
+// runTree runs the existing single-tree pipeline (discovery, move, namespace creation,
+// kustomization emission) over inputDirs, writing into o.outputDir. It returns the
+// namespaces used by the moved resources.
+func (o *Options) runTree(inputDirs []string, resourceScopes discovery.ResourceScopes, secretTransformer secrets.SecretTransformer) ([]string, error) {
 
 	var yamlFiles []string
-	for _, inputDir := range o.inputDirs {
+	for _, inputDir := range inputDirs {
 		files, err := listYAMLFiles(inputDir)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		yamlFiles = append(yamlFiles, files...)
 	}
@@ -112,15 +207,17 @@ func (o *Options) Run() error {
 		if err != nil {
 			log.Fatalf("Failed to build kubernetes REST client config: %v", err)
 		}
-		resourceInspector, err = discovery.NewAPIServerResourceInspector(restcfg)
+		resourceInspector, err = discovery.NewAPIServerResourceInspector(restcfg, resourceScopes)
 		if err != nil {
 			log.Fatalf("Failed to construct APIServer backed resource resource inspector: %v", err)
 		}
 	} else {
-		resourceInspector = discovery.NewLocalResourceInspector()
+		resourceInspector = discovery.NewLocalResourceInspector(resourceScopes)
 	}
 
-	// Find local resources defined by CRDs
+	// Find local resources defined by CRDs, also extending the scope fallback so that
+	// other versions of the same CRD (not directly referenced by a CR in the input set)
+	// resolve too
 	for _, yamlFile := range yamlFiles {
 		resources, err := findResources(yamlFile)
 		if err != nil {
@@ -128,26 +225,62 @@ func (o *Options) Run() error {
 		}
 		for gvk, namespaced := range resources {
 			resourceInspector.AddResource(gvk, namespaced)
+			resourceScopes[schema.GroupVersionKind{Group: gvk.Group, Kind: gvk.Kind}] = resourceScopeFor(namespaced)
 		}
 	}
 
-	// Collect used namespaces
-	var namespaces []string
+	// Parse every input file up front so --replacements can wire fields between configs
+	// regardless of which file they were read from
+	parsedFiles, err := parseYAMLFiles(yamlFiles)
+	if err != nil {
+		return nil, err
+	}
 
-	// Move each YAML file into output directory structure
-	for _, yamlFile := range yamlFiles {
-		err := o.moveFile(yamlFile, resourceInspector, &namespaces)
+	if o.replacementsFile != "" {
+		replacements, err := loadReplacements(o.replacementsFile)
 		if err != nil {
-			return err
+			return nil, errors.Wrapf(err, "failed to load --%s", replacementsFlag)
+		}
+
+		var allNodes []*yaml.RNode
+		for _, parsedFile := range parsedFiles {
+			allNodes = append(allNodes, parsedFile.nodes...)
+		}
+		if err := applyReplacements(allNodes, replacements); err != nil {
+			return nil, errors.Wrap(err, "failed to apply replacements")
+		}
+	}
+
+	// Move every parsed config into the output directory structure, fanning the
+	// per-config planning work out over --concurrency workers; the files themselves
+	// were already parsed above, one after another
+	namespaces, err := o.moveNodes(parsedFiles, resourceInspector, secretTransformer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove processed input files now that every config has been written
+	if o.removeInput {
+		for _, parsedFile := range parsedFiles {
+			if err := os.Remove(parsedFile.file); err != nil {
+				return nil, errors.Wrapf(err, "failed to remove input file %s", parsedFile.file)
+			}
 		}
 	}
 
 	// Create missing Namespace configs
 	if err := o.createMissingNamespaces(namespaces); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	// Generate kustomization.yaml files covering the output tree
+	if o.emitKustomization {
+		if err := o.writeKustomizations(); err != nil {
+			return nil, err
+		}
+	}
+
+	return namespaces, nil
 }
 
 // createMissingNamespaces creates missing Namespaces configs
@@ -200,6 +333,49 @@ func listYAMLFiles(inputDir string) ([]string, error) {
 	return files, err
 }
 
+// parseResourceScopes builds a discovery.ResourceScopes fallback table from the
+// --assume-namespaced and --assume-cluster-scoped flags, each of which is a
+// comma-separated list of Group/Kind entries (e.g. cert-manager.io/Certificate).
+func parseResourceScopes(assumeNamespaced, assumeClusterScoped []string) (discovery.ResourceScopes, error) {
+	scopes := discovery.ResourceScopes{}
+
+	if err := addResourceScopes(scopes, assumeNamespaced, apiextensionsv1beta1.NamespaceScoped); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse --%s", assumeNamespacedFlag)
+	}
+	if err := addResourceScopes(scopes, assumeClusterScoped, apiextensionsv1beta1.ClusterScoped); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse --%s", assumeClusterScopedFlag)
+	}
+
+	return scopes, nil
+}
+
+func addResourceScopes(scopes discovery.ResourceScopes, groupKinds []string, scope apiextensionsv1beta1.ResourceScope) error {
+	for _, entries := range groupKinds {
+		for _, entry := range strings.Split(entries, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			i := strings.LastIndex(entry, "/")
+			if i < 0 {
+				return fmt.Errorf("expected Group/Kind but got %q", entry)
+			}
+
+			scopes[schema.GroupVersionKind{Group: entry[:i], Kind: entry[i+1:]}] = scope
+		}
+	}
+
+	return nil
+}
+
+func resourceScopeFor(namespaced bool) apiextensionsv1beta1.ResourceScope {
+	if namespaced {
+		return apiextensionsv1beta1.NamespaceScoped
+	}
+	return apiextensionsv1beta1.ClusterScoped
+}
+
 // findResources finds resources defined as CRDs to add to discovery
 func findResources(inputFile string) (map[schema.GroupVersionKind]bool, error) {
 	resources := map[schema.GroupVersionKind]bool{}
@@ -266,48 +442,55 @@ func findResources(inputFile string) (map[schema.GroupVersionKind]bool, error) {
 	return resources, nil
 }
 
-// moveFile moves the input file into the right place in the output structure
-func (o *Options) moveFile(inputFile string, resourceInspector discovery.ResourceInspector, namespaces *[]string) error {
+// fileNodes holds the configs parsed from a single input file
+type fileNodes struct {
+	file  string
+	nodes []*yaml.RNode
+}
 
-	// Separate input file into individual configs
-	b, err := ioutil.ReadFile(inputFile)
-	if err != nil {
-		return err
-	}
-	nodes, err := kio.FromBytes(b)
-	if err != nil {
-		return err
-	}
+// parseYAMLFiles parses every input file into its individual configs
+func parseYAMLFiles(yamlFiles []string) ([]fileNodes, error) {
+	var parsedFiles []fileNodes
 
-	// Put each config into right location
-	for _, node := range nodes {
-		err = o.moveConfig(node, resourceInspector, namespaces)
+	for _, yamlFile := range yamlFiles {
+		b, err := ioutil.ReadFile(yamlFile)
 		if err != nil {
-			return errors.Wrapf(err, "failed to process input file %s", inputFile)
+			return nil, err
 		}
-	}
-
-	// Remove processed file
-	if o.removeInput {
-		err = os.Remove(inputFile)
+		nodes, err := kio.FromBytes(b)
 		if err != nil {
-			return errors.Wrapf(err, "failed to remove input file %s", inputFile)
+			return nil, err
 		}
+		parsedFiles = append(parsedFiles, fileNodes{file: yamlFile, nodes: nodes})
 	}
 
-	return nil
+	return parsedFiles, nil
 }
 
-func (o *Options) moveConfig(node *yaml.RNode, resourceInspector discovery.ResourceInspector, namespaces *[]string) error {
+// configPlan is the result of preparing a single config for output: where it should be
+// written, its final serialised content, and the namespace it added (if any). Computing
+// a configPlan touches only its own node, so it's safe to do concurrently across configs;
+// actually writing it to disk is left to the caller so destination collisions can be
+// detected centrally.
+type configPlan struct {
+	outputFile string
+	content    string
+	namespace  string
+}
+
+// planConfig works out where a config belongs in the output structure and prepares its
+// final content, without touching disk. It returns a nil plan for configs filtered out by
+// --filter-kind-group.
+func (o *Options) planConfig(node *yaml.RNode, resourceInspector discovery.ResourceInspector, secretTransformer secrets.SecretTransformer) (*configPlan, error) {
 
 	apiVersion, err := getAPIVersion(node)
 	if err != nil {
-		return errors.Wrap(err, "failed to get apiVersion")
+		return nil, errors.Wrap(err, "failed to get apiVersion")
 	}
 
 	kind, err := getKind(node)
 	if err != nil {
-		return errors.Wrap(err, "failed to get kind")
+		return nil, errors.Wrap(err, "failed to get kind")
 	}
 
 	gvk := schema.FromAPIVersionAndKind(apiVersion, kind)
@@ -315,23 +498,23 @@ func (o *Options) moveConfig(node *yaml.RNode, resourceInspector discovery.Resou
 	// Ignore filtered group.kinds
 	for _, filteredKindGroup := range o.filteredKindGroups {
 		if gvk.GroupKind().String() == filteredKindGroup {
-			return nil
+			return nil, nil
 		}
 	}
 
 	namespace, err := getNamespace(node)
 	if err != nil {
-		return errors.Wrap(err, "failed to get namespace")
+		return nil, errors.Wrap(err, "failed to get namespace")
 	}
 
 	name, err := getName(node)
 	if err != nil {
-		return errors.Wrap(err, "failed to get name")
+		return nil, errors.Wrap(err, "failed to get name")
 	}
 
 	isNamespaced, err := resourceInspector.IsNamespaced(gvk)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	isClusterScoped := !isNamespaced
@@ -341,11 +524,11 @@ func (o *Options) moveConfig(node *yaml.RNode, resourceInspector discovery.Resou
 			if o.clean {
 				err = node.SetNamespace("")
 				if err != nil {
-					return err
+					return nil, err
 				}
 				namespace = ""
 			} else {
-				return fmt.Errorf("namespace field should not be set for cluster-scoped resource: %s/%s", strings.ToLower(kind), name)
+				return nil, fmt.Errorf("namespace field should not be set for cluster-scoped resource: %s/%s", strings.ToLower(kind), name)
 			}
 		}
 
@@ -355,13 +538,12 @@ func (o *Options) moveConfig(node *yaml.RNode, resourceInspector discovery.Resou
 			subdirectory = pluralise(strings.ToLower(kind)) + "." + gvk.Group
 		}
 		outputFile = filepath.Join(o.outputDir, nonNamespacedDirectory, subdirectory, name+".yaml")
+		namespace = ""
 	} else {
 		if namespace == "" {
 			// TODO: use default namespace from kubeconfig
 			namespace = corev1.NamespaceDefault
 		}
-		// Add to known namespaces
-		*namespaces = append(*namespaces, namespace)
 
 		fileName := strings.ToLower(kind) + "-" + name + ".yaml"
 		// Prefix with group if core
@@ -371,23 +553,21 @@ func (o *Options) moveConfig(node *yaml.RNode, resourceInspector discovery.Resou
 		outputFile = filepath.Join(o.outputDir, namespacedDirectory, namespace, fileName)
 	}
 
-	// Create destination directory
-	err = os.MkdirAll(filepath.Dir(outputFile), defaultDirectoryPerms)
-	if err != nil {
-		return err
+	// Run Secrets through the configured --secret-mode transform so plaintext data
+	// doesn't reach the output tree
+	if gvk.Group == "" && kind == "Secret" {
+		node, err = secretTransformer.Transform(node)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to transform secret/%s", name)
+		}
 	}
 
-	// Create destination file
 	s, err := node.String()
 	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(outputFile, []byte(configSeparator+s), defaultFilePerms)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &configPlan{outputFile: outputFile, content: configSeparator + s, namespace: namespace}, nil
 }
 
 func getNamespace(node *yaml.RNode) (string, error) {
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dippynark/kfmt/discovery"
+	"github.com/dippynark/kfmt/secrets"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// moveJob is one config awaiting a configPlan, tagged with the file it came from so
+// planning errors can name it.
+type moveJob struct {
+	file string
+	node *yaml.RNode
+}
+
+// moveNodes plans and writes every config from parsedFiles into the output directory
+// structure. Walking the parsed configs and planning each (resourceInspector lookups,
+// secret transforms, YAML serialisation) is fanned out over o.concurrency workers; a
+// single goroutine owns the actual MkdirAll/WriteFile calls and the namespaces slice so
+// two configs destined for the same path are detected rather than racing.
+func (o *Options) moveNodes(parsedFiles []fileNodes, resourceInspector discovery.ResourceInspector, secretTransformer secrets.SecretTransformer) ([]string, error) {
+	concurrency := o.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan moveJob)
+	plans := make(chan *configPlan)
+
+	// done is closed whenever this function returns, including an early return from a
+	// plan error or output collision below. Without it, a worker blocked sending a plan
+	// (or the producer blocked sending a job) past that point would never unblock, since
+	// nothing is left draining jobs/plans, leaking goroutines until process exit.
+	done := make(chan struct{})
+	defer close(done)
+
+	var planErrOnce sync.Once
+	var planErr error
+
+	var workers sync.WaitGroup
+	workers.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				plan, err := o.planConfig(job.node, resourceInspector, secretTransformer)
+				if err != nil {
+					planErrOnce.Do(func() {
+						planErr = fmt.Errorf("failed to process input file %s: %w", job.file, err)
+					})
+					continue
+				}
+				if plan == nil {
+					// filtered out by --filter-kind-group
+					continue
+				}
+				select {
+				case plans <- plan:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		workers.Wait()
+		close(plans)
+	}()
+
+	go func() {
+		defer close(jobs)
+		for _, parsedFile := range parsedFiles {
+			for _, node := range parsedFile.nodes {
+				select {
+				case jobs <- moveJob{file: parsedFile.file, node: node}:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	written := map[string]bool{}
+	var namespaces []string
+	for plan := range plans {
+		if written[plan.outputFile] {
+			return nil, fmt.Errorf("collision writing to %s: two input configs resolved to the same output path", plan.outputFile)
+		}
+		written[plan.outputFile] = true
+
+		if err := os.MkdirAll(filepath.Dir(plan.outputFile), defaultDirectoryPerms); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(plan.outputFile, []byte(plan.content), defaultFilePerms); err != nil {
+			return nil, err
+		}
+
+		if plan.namespace != "" {
+			namespaces = append(namespaces, plan.namespace)
+		}
+	}
+
+	if planErr != nil {
+		return nil, planErr
+	}
+
+	return namespaces, nil
+}
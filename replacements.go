@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// Replacement mirrors a kustomize Replacement entry: copy a field from one config into
+// one or more fields on other configs.
+type Replacement struct {
+	Source  ReplacementSource   `json:"source"`
+	Targets []ReplacementTarget `json:"targets"`
+}
+
+// ReplacementSource selects the single config a value is read from, and the fieldPath it
+// is read from.
+type ReplacementSource struct {
+	Kind      string `json:"kind,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	FieldPath string `json:"fieldPath,omitempty"`
+}
+
+// ReplacementTarget selects the configs a value is copied into, and the fieldPaths it is
+// copied to.
+type ReplacementTarget struct {
+	Select     ReplacementSource  `json:"select"`
+	FieldPaths []string           `json:"fieldPaths"`
+	Options    ReplacementOptions `json:"options,omitempty"`
+}
+
+// ReplacementOptions controls how a value is written into a target fieldPath.
+type ReplacementOptions struct {
+	// Delimiter splits the existing target value for a partial, positional substitution
+	// (e.g. replacing only the tag in "image:tag").
+	Delimiter string `json:"delimiter,omitempty"`
+	// Index selects which delimited part to replace; negative counts from the end.
+	Index int `json:"index,omitempty"`
+	// Create adds the target fieldPath when it doesn't already exist.
+	Create bool `json:"create,omitempty"`
+}
+
+// loadReplacements reads a list of Replacement entries from file
+func loadReplacements(file string) ([]Replacement, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var replacements []Replacement
+	if err := sigsyaml.Unmarshal(b, &replacements); err != nil {
+		return nil, err
+	}
+
+	return replacements, nil
+}
+
+// resourceNode pairs a parsed config with the GVK/namespace/name it was indexed under
+type resourceNode struct {
+	gvk       schema.GroupVersionKind
+	namespace string
+	name      string
+	node      *yaml.RNode
+}
+
+// applyReplacements resolves each Replacement's source field against nodes and copies it
+// into every matching target fieldPath, mutating nodes in place.
+func applyReplacements(nodes []*yaml.RNode, replacements []Replacement) error {
+	index, err := indexResourceNodes(nodes)
+	if err != nil {
+		return err
+	}
+
+	for _, replacement := range replacements {
+		if err := applyReplacement(index, replacement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func indexResourceNodes(nodes []*yaml.RNode) ([]resourceNode, error) {
+	var index []resourceNode
+
+	for _, node := range nodes {
+		apiVersion, err := getAPIVersion(node)
+		if err != nil {
+			return nil, err
+		}
+		kind, err := getKind(node)
+		if err != nil {
+			return nil, err
+		}
+		name, err := getName(node)
+		if err != nil {
+			return nil, err
+		}
+		namespace, err := getNamespace(node)
+		if err != nil {
+			return nil, err
+		}
+
+		gvk := schema.FromAPIVersionAndKind(apiVersion, kind)
+		index = append(index, resourceNode{gvk: gvk, namespace: namespace, name: name, node: node})
+	}
+
+	return index, nil
+}
+
+func applyReplacement(index []resourceNode, replacement Replacement) error {
+	sources := selectResourceNodes(index, replacement.Source)
+	if len(sources) == 0 {
+		return fmt.Errorf("no matches for selector %s", describeSelector(replacement.Source))
+	}
+	if len(sources) > 1 {
+		return fmt.Errorf("multiple matches for selector %s", describeSelector(replacement.Source))
+	}
+	source := sources[0]
+
+	fieldPath := splitFieldPath(replacement.Source.FieldPath)
+	value, err := source.node.Pipe(yaml.Lookup(fieldPath...))
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return fmt.Errorf("fieldPath `%s` is missing for replacement source %s", replacement.Source.FieldPath, describeResource(source))
+	}
+
+	for _, target := range replacement.Targets {
+		targets := selectResourceNodes(index, target.Select)
+		for _, t := range targets {
+			for _, fieldPath := range target.FieldPaths {
+				if err := setReplacementValue(t.node, fieldPath, value, target.Options); err != nil {
+					return errors.Wrapf(err, "failed to set fieldPath `%s` on %s", fieldPath, describeResource(t))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func selectResourceNodes(index []resourceNode, selector ReplacementSource) []resourceNode {
+	var matches []resourceNode
+	for _, candidate := range index {
+		if selector.Kind != "" && candidate.gvk.Kind != selector.Kind {
+			continue
+		}
+		if selector.Group != "" && candidate.gvk.Group != selector.Group {
+			continue
+		}
+		if selector.Version != "" && candidate.gvk.Version != selector.Version {
+			continue
+		}
+		if selector.Name != "" && candidate.name != selector.Name {
+			continue
+		}
+		if selector.Namespace != "" && candidate.namespace != selector.Namespace {
+			continue
+		}
+		matches = append(matches, candidate)
+	}
+	return matches
+}
+
+// setReplacementValue copies value into node at fieldPath, honouring options.delimiter and
+// options.index for a partial substitution and options.create to add a missing field. A
+// mapping or sequence value is written as-is rather than serialised to a string, so copying
+// e.g. spec.template.spec.containers doesn't flatten it into a single scalar.
+func setReplacementValue(node *yaml.RNode, fieldPath string, value *yaml.RNode, options ReplacementOptions) error {
+	fields := splitFieldPath(fieldPath)
+
+	existing, err := node.Pipe(yaml.Lookup(fields...))
+	if err != nil {
+		return err
+	}
+	if existing == nil && !options.Create {
+		return nil
+	}
+
+	if value.YNode().Kind != yaml.ScalarNode {
+		return node.PipeE(yaml.LookupCreate(value.YNode().Kind, fields...), yaml.FieldSetter{Value: value})
+	}
+
+	replacement, err := value.String()
+	if err != nil {
+		return err
+	}
+	replacement = trimSpaceAndQuotes(replacement)
+
+	if options.Delimiter != "" && existing != nil {
+		existingValue, err := existing.String()
+		if err != nil {
+			return err
+		}
+		existingValue = trimSpaceAndQuotes(existingValue)
+
+		parts := strings.Split(existingValue, options.Delimiter)
+		index := options.Index
+		if index < 0 {
+			index += len(parts)
+		}
+		if index < 0 || index >= len(parts) {
+			return fmt.Errorf("options.index %d out of range for %q delimited by %q", options.Index, existingValue, options.Delimiter)
+		}
+
+		parts[index] = replacement
+		replacement = strings.Join(parts, options.Delimiter)
+	}
+
+	return node.PipeE(yaml.LookupCreate(yaml.ScalarNode, fields...), yaml.FieldSetter{StringValue: replacement})
+}
+
+// splitFieldPath splits a dotted kustomize fieldPath (e.g. "spec.template.spec.containers.[name=app].image")
+// into the path segments expected by yaml.Lookup/yaml.LookupCreate, keeping any "[...]"
+// bracket selector intact even when its value itself contains dots (e.g.
+// "metadata.labels.[app.kubernetes.io/name=foo]").
+func splitFieldPath(fieldPath string) []string {
+	var fields []string
+
+	var current strings.Builder
+	depth := 0
+	for _, r := range fieldPath {
+		switch {
+		case r == '[':
+			depth++
+			current.WriteRune(r)
+		case r == ']':
+			depth--
+			current.WriteRune(r)
+		case r == '.' && depth == 0:
+			fields = append(fields, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	fields = append(fields, current.String())
+
+	return fields
+}
+
+func describeSelector(selector ReplacementSource) string {
+	var parts []string
+	if selector.Kind != "" {
+		parts = append(parts, fmt.Sprintf("kind: %s", selector.Kind))
+	}
+	if selector.Group != "" {
+		parts = append(parts, fmt.Sprintf("group: %s", selector.Group))
+	}
+	if selector.Version != "" {
+		parts = append(parts, fmt.Sprintf("version: %s", selector.Version))
+	}
+	if selector.Name != "" {
+		parts = append(parts, fmt.Sprintf("name: %s", selector.Name))
+	}
+	if selector.Namespace != "" {
+		parts = append(parts, fmt.Sprintf("namespace: %s", selector.Namespace))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func describeResource(r resourceNode) string {
+	if r.namespace != "" {
+		return fmt.Sprintf("%s %s/%s", r.gvk.String(), r.namespace, r.name)
+	}
+	return fmt.Sprintf("%s %s", r.gvk.String(), r.name)
+}
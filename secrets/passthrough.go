@@ -0,0 +1,10 @@
+package secrets
+
+import "sigs.k8s.io/kustomize/kyaml/yaml"
+
+// passthroughTransformer returns the node unchanged; it is the default SecretTransformer.
+type passthroughTransformer struct{}
+
+func (passthroughTransformer) Transform(node *yaml.RNode) (*yaml.RNode, error) {
+	return node, nil
+}
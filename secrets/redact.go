@@ -0,0 +1,45 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// redactTransformer replaces Secret data/stringData values with a stable hash
+// placeholder, so a diff shows that a value changed without ever writing out
+// the plaintext.
+type redactTransformer struct{}
+
+func (redactTransformer) Transform(node *yaml.RNode) (*yaml.RNode, error) {
+	for _, field := range []string{"data", "stringData"} {
+		fieldNode, err := node.Pipe(yaml.Lookup(field))
+		if err != nil {
+			return nil, err
+		}
+		if fieldNode == nil {
+			continue
+		}
+
+		err = fieldNode.VisitFields(func(entry *yaml.MapNode) error {
+			value, err := entry.Value.String()
+			if err != nil {
+				return err
+			}
+			return entry.Value.PipeE(yaml.FieldSetter{StringValue: redactedValue(value)})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// redactedValue returns a short, stable placeholder for value so that repeated runs
+// over the same input produce the same output
+func redactedValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "REDACTED-" + hex.EncodeToString(sum[:])[:12]
+}
@@ -0,0 +1,109 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// inClusterCAFile and inClusterTokenFile are where the mounted service account credentials
+// live inside a pod, matching k8s.io/client-go/rest.InClusterConfig.
+const (
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// sealedSecretsTransformer posts each Secret to a kubeseal controller and replaces it
+// with the returned SealedSecret, so only the controller's private key can decrypt it.
+type sealedSecretsTransformer struct {
+	controllerURL string
+	httpClient    *http.Client
+	bearerToken   string
+}
+
+// newSealedSecretsTransformer builds the transformer's http.Client from opts: a client
+// certificate (CertFile/KeyFile) and/or a custom CA (CAFile) are used to talk to a
+// controller exposed over mTLS/a private CA, and InCluster authenticates against the
+// controller using the pod's own service account token and cluster CA, matching how
+// in-cluster clients normally reach other services on the cluster.
+func newSealedSecretsTransformer(controllerURL string, opts Options) (sealedSecretsTransformer, error) {
+	t := sealedSecretsTransformer{controllerURL: controllerURL}
+
+	tlsConfig := &tls.Config{}
+	caFile := opts.CAFile
+
+	if opts.InCluster {
+		token, err := ioutil.ReadFile(inClusterTokenFile)
+		if err != nil {
+			return t, fmt.Errorf("failed to read in-cluster service account token: %w", err)
+		}
+		t.bearerToken = string(token)
+		if caFile == "" {
+			caFile = inClusterCAFile
+		}
+	}
+
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return t, fmt.Errorf("failed to read CA file %s: %w", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return t, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return t, fmt.Errorf("--secret-cert-file and --secret-key-file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return t, fmt.Errorf("failed to load --secret-cert-file/--secret-key-file: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	t.httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+	return t, nil
+}
+
+func (t sealedSecretsTransformer) Transform(node *yaml.RNode) (*yaml.RNode, error) {
+	plaintext, err := node.String()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.controllerURL, bytes.NewReader([]byte(plaintext)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	if t.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+t.bearerToken)
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach kubeseal controller at %s: %w", t.controllerURL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubeseal controller returned %s: %s", resp.Status, string(body))
+	}
+
+	return yaml.Parse(string(body))
+}
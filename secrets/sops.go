@@ -0,0 +1,43 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// sopsTransformer shells out to sops to encrypt Secret data/stringData values in place,
+// leaving the rest of the manifest (including metadata relied on by GitOps tooling) readable.
+type sopsTransformer struct {
+	recipient string
+	pgp       bool
+}
+
+func (t sopsTransformer) Transform(node *yaml.RNode) (*yaml.RNode, error) {
+	plaintext, err := node.String()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"--encrypt", "--input-type", "yaml", "--output-type", "yaml", "--encrypted-regex", "^(data|stringData)$"}
+	if t.pgp {
+		args = append(args, "--pgp", t.recipient)
+	} else {
+		args = append(args, "--age", t.recipient)
+	}
+	args = append(args, "/dev/stdin")
+
+	cmd := exec.Command("sops", args...)
+	cmd.Stdin = strings.NewReader(plaintext)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("sops encrypt failed: %v: %s", err, stderr.String())
+	}
+
+	return yaml.Parse(stdout.String())
+}
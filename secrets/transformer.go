@@ -0,0 +1,69 @@
+// Package secrets provides pluggable transforms applied to v1/Secret configs before
+// they are written to disk, so that a GitOps-ready tree produced by kfmt doesn't end
+// up committing plaintext Secret data.
+package secrets
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	// ModePassthrough leaves Secret configs unchanged (the default).
+	ModePassthrough = "passthrough"
+	// ModeRedact replaces data/stringData values with a hash placeholder.
+	ModeRedact = "redact"
+	// ModeSops encrypts data/stringData values in place using sops.
+	ModeSops = "sops"
+	// ModeSealedSecrets replaces the Secret with the SealedSecret returned by a
+	// kubeseal controller.
+	ModeSealedSecrets = "sealed-secrets"
+)
+
+// SecretTransformer rewrites a v1/Secret node before it is written to disk, e.g. to
+// redact or encrypt its data so plaintext secrets never reach the output tree.
+type SecretTransformer interface {
+	Transform(node *yaml.RNode) (*yaml.RNode, error)
+}
+
+// Options configures the SecretTransformer constructed by New.
+type Options struct {
+	// Recipient is the age or PGP recipient used in ModeSops, or the kubeseal
+	// controller URL used in ModeSealedSecrets.
+	Recipient string
+	// PGP selects a PGP recipient over the default age recipient in ModeSops.
+	PGP bool
+	// CertFile and KeyFile are an optional client certificate used to authenticate to
+	// the kubeseal controller in ModeSealedSecrets.
+	CertFile string
+	KeyFile  string
+	// CAFile is an optional CA bundle used to verify the kubeseal controller's
+	// certificate in ModeSealedSecrets. Defaults to the cluster CA when InCluster is set.
+	CAFile string
+	// InCluster authenticates to the kubeseal controller in ModeSealedSecrets using the
+	// pod's own service account token and cluster CA, as when running inside the cluster.
+	InCluster bool
+}
+
+// New constructs the SecretTransformer for the given --secret-mode.
+func New(mode string, opts Options) (SecretTransformer, error) {
+	switch mode {
+	case "", ModePassthrough:
+		return passthroughTransformer{}, nil
+	case ModeRedact:
+		return redactTransformer{}, nil
+	case ModeSops:
+		if opts.Recipient == "" {
+			return nil, fmt.Errorf("--secret-recipient is required for --secret-mode=%s", ModeSops)
+		}
+		return sopsTransformer{recipient: opts.Recipient, pgp: opts.PGP}, nil
+	case ModeSealedSecrets:
+		if opts.Recipient == "" {
+			return nil, fmt.Errorf("--secret-recipient (kubeseal controller URL) is required for --secret-mode=%s", ModeSealedSecrets)
+		}
+		return newSealedSecretsTransformer(opts.Recipient, opts)
+	default:
+		return nil, fmt.Errorf("unknown --secret-mode: %s", mode)
+	}
+}